@@ -0,0 +1,24 @@
+package ingester
+
+import "testing"
+
+// TestResidentMemoryChunksExcludesEvicted ensures the evictor's watermark
+// checks are gated on a count that eviction itself actually moves.
+// evict() only nulls a chunkDesc's bytes (it doesn't shrink memoryChunks,
+// which tracks chunkDesc count, not resident bytes), so the evictor must
+// compare against memoryChunks minus evictedChunks, not memoryChunks alone.
+func TestResidentMemoryChunksExcludesEvicted(t *testing.T) {
+	before := residentMemoryChunks()
+
+	memoryChunks.Add(5)
+	defer memoryChunks.Sub(5)
+	if got, want := residentMemoryChunks(), before+5; got != want {
+		t.Fatalf("after adding 5 memoryChunks: got %v, want %v", got, want)
+	}
+
+	evictedChunks.Add(2)
+	defer evictedChunks.Sub(2)
+	if got, want := residentMemoryChunks(), before+3; got != want {
+		t.Fatalf("after evicting 2 of them: got %v, want %v", got, want)
+	}
+}
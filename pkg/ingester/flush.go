@@ -76,6 +76,17 @@ var (
 // Flush triggers a flush of all the chunks and closes the flush queues.
 // Called from the Lifecycler as part of the ingester shutdown.
 func (i *Ingester) Flush() {
+	// Stop the evictor before userStates starts being torn down below: it
+	// walks userStates on its own goroutine and has no other shutdown
+	// signal.
+	i.stopEviction()
+
+	// Stop the adaptive worker rebalancer before flushQueuesDone.Wait()
+	// below: rebalanceFlushWorkers calls flushQueuesDone.Add(1) to spin up
+	// extra workers, and that must not still be happening concurrently with
+	// the Wait().
+	i.stopFlushScheduler()
+
 	level.Info(util.Logger).Log("msg", "starting to flush all the chunks")
 	i.sweepUsers(true)
 	level.Info(util.Logger).Log("msg", "flushing of chunks complete")
@@ -86,6 +97,11 @@ func (i *Ingester) Flush() {
 	}
 
 	i.flushQueuesDone.Wait()
+
+	// Flush whatever's still pending in a segment buffer (the last round of
+	// flushUserSeries calls may have left a partially-filled one) before
+	// shutdown completes.
+	i.stopSegmentBuffers()
 }
 
 // FlushHandler triggers a flush of all in memory chunks.  Mainly used for
@@ -102,14 +118,24 @@ type flushOp struct {
 	userID    string
 	fp        model.Fingerprint
 	immediate bool
+	bytes     int64
+	stale     bool
 }
 
 func (o *flushOp) Key() string {
 	return fmt.Sprintf("%s-%d-%v", o.userID, o.fp, o.immediate)
 }
 
+// Priority weights chunk age, series size and staleness so that, under
+// pressure, the largest/oldest/stalest series drain first. Age is the base
+// signal (as before); bytes and staleness are folded in as a bonus
+// expressed in the same units (nanoseconds) so they compose with it.
 func (o *flushOp) Priority() int64 {
-	return -int64(o.from)
+	priority := -int64(o.from)*int64(time.Millisecond) + o.bytes*priorityBytesWeight
+	if o.stale {
+		priority += int64(priorityStaleBonus)
+	}
+	return priority
 }
 
 // sweepUsers periodically schedules series for flushing and garbage collects users with no series
@@ -118,12 +144,13 @@ func (i *Ingester) sweepUsers(immediate bool) {
 		return
 	}
 
+	maxAge, maxIdle, pressure := i.flushThresholds()
 	oldest := model.Time(0)
 
 	for id, state := range i.userStates.cp() {
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
-			i.sweepSeries(id, pair.fp, pair.series, immediate)
+			i.sweepSeries(id, pair.fp, pair.series, immediate, maxAge, maxIdle, pressure)
 			i.removeFlushedChunks(state, pair.fp, pair.series)
 			first := pair.series.firstUnflushedChunkTime()
 			state.fpLocker.Unlock(pair.fp)
@@ -147,6 +174,7 @@ const (
 	reasonIdle
 	reasonStale
 	reasonSpreadFlush
+	reasonMemoryPressure
 )
 
 func (f flushReason) String() string {
@@ -165,6 +193,8 @@ func (f flushReason) String() string {
 		return "Stale"
 	case reasonSpreadFlush:
 		return "Spread"
+	case reasonMemoryPressure:
+		return "MemoryPressure"
 	default:
 		panic("unrecognised flushReason")
 	}
@@ -174,25 +204,27 @@ func (f flushReason) String() string {
 //
 // NB we don't close the head chunk here, as the series could wait in the queue
 // for some time, and we want to encourage chunks to be as full as possible.
-func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memorySeries, immediate bool) {
+func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memorySeries, immediate bool, maxAge, maxIdle time.Duration, pressure bool) {
 	if len(series.chunkDescs) <= 0 {
 		return
 	}
 
 	firstTime := series.firstTime()
-	flush := i.shouldFlushSeries(series, fp, immediate)
+	stale := series.isStale()
+	flush := i.shouldFlushSeries(series, fp, immediate, maxAge, maxIdle, pressure)
 	if flush == noFlush {
 		return
 	}
 
 	flushQueueIndex := int(uint64(fp) % uint64(i.cfg.ConcurrentFlushes))
-	if i.flushQueues[flushQueueIndex].Enqueue(&flushOp{firstTime, userID, fp, immediate}) {
+	op := &flushOp{firstTime, userID, fp, immediate, seriesByteSize(series), stale}
+	if i.flushQueues[flushQueueIndex].Enqueue(op) {
 		flushReasons.WithLabelValues(flush.String()).Inc()
 		util.Event().Log("msg", "add to flush queue", "userID", userID, "reason", flush, "firstTime", firstTime, "fp", fp, "series", series.metric, "nlabels", len(series.metric), "queue", flushQueueIndex)
 	}
 }
 
-func (i *Ingester) shouldFlushSeries(series *memorySeries, fp model.Fingerprint, immediate bool) flushReason {
+func (i *Ingester) shouldFlushSeries(series *memorySeries, fp model.Fingerprint, immediate bool, maxAge, maxIdle time.Duration, pressure bool) flushReason {
 	if len(series.chunkDescs) == 0 {
 		return noFlush
 	}
@@ -208,10 +240,10 @@ func (i *Ingester) shouldFlushSeries(series *memorySeries, fp model.Fingerprint,
 		return reasonMultipleChunksInSeries
 	}
 	// Otherwise look in more detail at the first chunk
-	return i.shouldFlushChunk(series.chunkDescs[0], fp, series.isStale())
+	return i.shouldFlushChunk(series.chunkDescs[0], fp, series.isStale(), maxAge, maxIdle, pressure)
 }
 
-func (i *Ingester) shouldFlushChunk(c *desc, fp model.Fingerprint, lastValueIsStale bool) flushReason {
+func (i *Ingester) shouldFlushChunk(c *desc, fp model.Fingerprint, lastValueIsStale bool, maxAge, maxIdle time.Duration, pressure bool) flushReason {
 	if c.flushed { // don't flush chunks we've already flushed
 		return noFlush
 	}
@@ -221,13 +253,21 @@ func (i *Ingester) shouldFlushChunk(c *desc, fp model.Fingerprint, lastValueIsSt
 	if i.cfg.ChunkAgeJitter != 0 {
 		jitter = time.Duration(fp) % i.cfg.ChunkAgeJitter
 	}
-	// Chunks should be flushed if they span longer than MaxChunkAge
-	if c.LastTime.Sub(c.FirstTime) > (i.cfg.MaxChunkAge - jitter) {
+	// Chunks should be flushed if they span longer than maxAge, which is
+	// shrunk from cfg.MaxChunkAge while under memory pressure.
+	if c.LastTime.Sub(c.FirstTime) > (maxAge - jitter) {
+		if pressure {
+			return reasonMemoryPressure
+		}
 		return reasonAged
 	}
 
-	// Chunk should be flushed if their last update is older then MaxChunkIdle.
-	if model.Now().Sub(c.LastUpdate) > i.cfg.MaxChunkIdle {
+	// Chunk should be flushed if their last update is older than maxIdle,
+	// likewise shrunk under memory pressure.
+	if model.Now().Sub(c.LastUpdate) > maxIdle {
+		if pressure {
+			return reasonMemoryPressure
+		}
 		return reasonIdle
 	}
 
@@ -241,6 +281,21 @@ func (i *Ingester) shouldFlushChunk(c *desc, fp model.Fingerprint, lastValueIsSt
 	return noFlush
 }
 
+// seriesByteSize sums the encoded size of a series' chunks, used to weight
+// flushOp.Priority() so the largest series drain first under pressure.
+func seriesByteSize(series *memorySeries) int64 {
+	var total int64
+	for _, d := range series.chunkDescs {
+		enc, err := d.Pin(notEvictableLoader)
+		if err != nil {
+			continue
+		}
+		total += int64(enc.Size())
+		d.Unpin()
+	}
+	return total
+}
+
 func (i *Ingester) flushLoop(j int) {
 	defer func() {
 		level.Debug(util.Logger).Log("msg", "Ingester.flushLoop() exited")
@@ -283,18 +338,25 @@ func (i *Ingester) flushUserSeries(flushQueueIndex int, userID string, fp model.
 		return nil
 	}
 
+	maxAge, maxIdle, pressure := i.flushThresholds()
+
 	userState.fpLocker.Lock(fp)
-	reason := i.shouldFlushSeries(series, fp, immediate)
+	reason := i.shouldFlushSeries(series, fp, immediate, maxAge, maxIdle, pressure)
 	if reason == noFlush {
 		userState.fpLocker.Unlock(fp)
 		return nil
 	}
 
+	flushStart := time.Now()
+	defer func() {
+		flushLatencyByReason.WithLabelValues(reason.String()).Observe(time.Since(flushStart).Seconds())
+	}()
+
 	// shouldFlushSeries() has told us we have at least one chunk
 	chunks := series.chunkDescs
 	if immediate {
 		series.closeHead(reasonImmediate)
-	} else if chunkReason := i.shouldFlushChunk(series.head(), fp, series.isStale()); chunkReason != noFlush {
+	} else if chunkReason := i.shouldFlushChunk(series.head(), fp, series.isStale(), maxAge, maxIdle, pressure); chunkReason != noFlush {
 		series.closeHead(chunkReason)
 	} else {
 		// The head chunk doesn't need flushing; step back by one.
@@ -340,7 +402,7 @@ func (i *Ingester) flushUserSeries(flushQueueIndex int, userID string, fp model.
 	sp.SetTag("organization", userID)
 
 	util.Event().Log("msg", "flush chunks", "userID", userID, "reason", reason, "numChunks", len(chunks), "firstTime", chunks[0].FirstTime, "fp", fp, "series", series.metric, "nlabels", len(series.metric), "queue", flushQueueIndex)
-	err := i.flushChunks(ctx, userID, fp, series.metric, chunks)
+	err := i.flushChunks(ctx, flushQueueIndex, userID, fp, series.metric, chunks)
 	if err != nil {
 		return err
 	}
@@ -357,6 +419,11 @@ func (i *Ingester) flushUserSeries(flushQueueIndex int, userID string, fp model.
 		}
 	}
 	userState.fpLocker.Unlock(fp)
+
+	// Chunks are now durably in the chunk store and either marked flushed
+	// above or, for an immediate flush, removed with their series, so the
+	// next WAL checkpoint no longer records them as unflushed and the
+	// segments that covered them become eligible for truncation.
 	return nil
 }
 
@@ -377,17 +444,30 @@ func (i *Ingester) removeFlushedChunks(userState *userState, fp model.Fingerprin
 	}
 }
 
-func (i *Ingester) flushChunks(ctx context.Context, userID string, fp model.Fingerprint, metric labels.Labels, chunkDescs []*desc) error {
+func (i *Ingester) flushChunks(ctx context.Context, flushQueueIndex int, userID string, fp model.Fingerprint, metric labels.Labels, chunkDescs []*desc) error {
 	wireChunks := make([]chunk.Chunk, 0, len(chunkDescs))
 	for _, chunkDesc := range chunkDescs {
-		c := chunk.NewChunk(userID, fp, metric, chunkDesc.C, chunkDesc.FirstTime, chunkDesc.LastTime)
+		// The evictor only drops bytes for chunks already marked flushed, but
+		// an immediate flush hands over every chunkDesc of the series,
+		// including retained flushed ones that may have been evicted; those
+		// are fetched back from the chunk store by loadEvicted.
+		enc, err := i.loadEvicted(ctx, userID, metric, chunkDesc)
+		if err != nil {
+			return err
+		}
+		enc = i.maybeTranscodeChunk(enc)
+		c := chunk.NewChunk(userID, fp, metric, enc, chunkDesc.FirstTime, chunkDesc.LastTime)
+		chunkDesc.Unpin()
 		if err := c.Encode(); err != nil {
 			return err
 		}
 		wireChunks = append(wireChunks, c)
 	}
 
-	if err := i.chunkStore.Put(ctx, wireChunks); err != nil {
+	putStart := time.Now()
+	err := i.putChunks(ctx, flushQueueIndex, userID, fp, wireChunks)
+	putLatency.observe(time.Since(putStart))
+	if err != nil {
 		return err
 	}
 
@@ -395,7 +475,13 @@ func (i *Ingester) flushChunks(ctx context.Context, userID string, fp model.Fing
 	countPerUser := chunksPerUser.WithLabelValues(userID)
 	// Record statistsics only when actual put request did not return error.
 	for _, chunkDesc := range chunkDescs {
-		utilization, length, size := chunkDesc.C.Utilization(), chunkDesc.C.Len(), chunkDesc.C.Size()
+		enc, err := i.loadEvicted(ctx, userID, metric, chunkDesc)
+		if err != nil {
+			return err
+		}
+		utilization, length, size := enc.Utilization(), enc.Len(), enc.Size()
+		chunkDesc.Unpin()
+
 		util.Event().Log("msg", "chunk flushed", "userID", userID, "fp", fp, "series", metric, "nlabels", len(metric), "utilization", utilization, "length", length, "size", size, "firstTime", chunkDesc.FirstTime, "lastTime", chunkDesc.LastTime)
 		chunkUtilization.Observe(utilization)
 		chunkLength.Observe(float64(length))
@@ -0,0 +1,308 @@
+package ingester
+
+import (
+	"flag"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+const (
+	// priorityBytesWeight converts a flushOp's series size into the same
+	// nanosecond-ish units flushOp.Priority()'s age term is already in, so
+	// a handful of extra bytes doesn't drown out age, but a genuinely large
+	// series still jumps the queue.
+	priorityBytesWeight = int64(time.Millisecond)
+	// priorityStaleBonus gives series with a stale marker a flat boost,
+	// roughly equivalent to an extra hour of age.
+	priorityStaleBonus = time.Hour
+
+	// flushQueueDepthPerWorker is the rule of thumb used to decide how many
+	// extra workers a backlog justifies: one more worker per this many
+	// queued ops.
+	flushQueueDepthPerWorker = 50
+	// adaptiveWorkerIdleRounds is how many consecutive empty queue checks an
+	// extra worker waits through before deciding the backlog has cleared
+	// and exiting.
+	adaptiveWorkerIdleRounds = 3
+	// adaptiveWorkerPollInterval is how often an otherwise-idle extra
+	// worker re-checks its queue, instead of parking indefinitely in a
+	// blocking Dequeue that would never let it notice the backlog cleared.
+	adaptiveWorkerPollInterval = 2 * time.Second
+)
+
+var (
+	flushWorkersActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_ingester_flush_workers",
+		Help: "Current number of active flush workers, per queue shard.",
+	}, []string{"queue"})
+	flushQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_ingester_flush_queue_length_adaptive",
+		Help: "Length of the flush queue, per shard, as seen by the adaptive worker scaler.",
+	}, []string{"queue"})
+	flushLatencyByReason = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cortex_ingester_flush_latency_seconds",
+		Help:    "Time spent in flushUserSeries, by flush reason.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"reason"})
+)
+
+// AdaptiveFlushConfig configures priority- and memory-aware flush
+// scheduling: how aggressively to flush under memory pressure, and how many
+// flush workers to run per queue shard.
+type AdaptiveFlushConfig struct {
+	SoftMemoryWatermark     int           `yaml:"soft_memory_watermark_chunks"`
+	HardMemoryWatermark     int           `yaml:"hard_memory_watermark_chunks"`
+	PressureChunkAgeFactor  float64       `yaml:"pressure_chunk_age_factor"`
+	PressureChunkIdleFactor float64       `yaml:"pressure_chunk_idle_factor"`
+	MinConcurrentFlushes    int           `yaml:"min_concurrent_flushes"`
+	MaxConcurrentFlushes    int           `yaml:"max_concurrent_flushes"`
+	MaxAcceptablePutLatency time.Duration `yaml:"max_acceptable_put_latency"`
+	WorkerScaleInterval     time.Duration `yaml:"worker_scale_interval"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *AdaptiveFlushConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.SoftMemoryWatermark, "ingester.flush-soft-memory-watermark", 0, "Number of in-memory chunks above which sweeps start shrinking MaxChunkAge/MaxChunkIdle. 0 disables.")
+	f.IntVar(&cfg.HardMemoryWatermark, "ingester.flush-hard-memory-watermark", 0, "Number of in-memory chunks above which sweeps aggressively shrink MaxChunkAge/MaxChunkIdle. 0 disables.")
+	f.Float64Var(&cfg.PressureChunkAgeFactor, "ingester.flush-pressure-chunk-age-factor", 0.5, "Factor applied to MaxChunkAge once the hard watermark is crossed.")
+	f.Float64Var(&cfg.PressureChunkIdleFactor, "ingester.flush-pressure-chunk-idle-factor", 0.5, "Factor applied to MaxChunkIdle once the hard watermark is crossed.")
+	f.IntVar(&cfg.MinConcurrentFlushes, "ingester.flush-min-concurrent-flushes", 0, "Subtracted from the max to give how many extra flush workers a queue shard may start on top of its one always-running worker. No extra workers are kept running at this level when the queue is idle.")
+	f.IntVar(&cfg.MaxConcurrentFlushes, "ingester.flush-max-concurrent-flushes", 0, "Caps the extra flush workers per queue shard at this value minus the min. Adaptive scaling is off unless this is greater than the min.")
+	f.DurationVar(&cfg.MaxAcceptablePutLatency, "ingester.flush-max-acceptable-put-latency", 2*time.Second, "Stop adding flush workers once the chunk store's Put latency exceeds this, since more workers would just add backend load.")
+	f.DurationVar(&cfg.WorkerScaleInterval, "ingester.flush-worker-scale-interval", 15*time.Second, "How often to reconsider the number of flush workers per queue shard.")
+}
+
+// flushThresholds returns the MaxChunkAge/MaxChunkIdle to use for the
+// current sweep, shrunk if memoryChunks has crossed a configured watermark,
+// along with whether any shrinking was applied.
+func (i *Ingester) flushThresholds() (maxAge, maxIdle time.Duration, pressure bool) {
+	cfg := i.cfg.Adaptive
+	maxAge, maxIdle = i.cfg.MaxChunkAge, i.cfg.MaxChunkIdle
+
+	chunks := currentMemoryChunks()
+	switch {
+	case cfg.HardMemoryWatermark > 0 && chunks > float64(cfg.HardMemoryWatermark):
+		return scaleDuration(maxAge, cfg.PressureChunkAgeFactor), scaleDuration(maxIdle, cfg.PressureChunkIdleFactor), true
+	case cfg.SoftMemoryWatermark > 0 && chunks > float64(cfg.SoftMemoryWatermark):
+		// Ease in half as aggressively as the hard watermark does.
+		return scaleDuration(maxAge, (1+cfg.PressureChunkAgeFactor)/2), scaleDuration(maxIdle, (1+cfg.PressureChunkIdleFactor)/2), true
+	default:
+		return maxAge, maxIdle, false
+	}
+}
+
+func scaleDuration(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * factor)
+}
+
+// putLatency tracks a rolling estimate of chunk store Put/PutSegment
+// latency so manageFlushWorkers can tell whether adding workers would help
+// or just pile more load onto an already-slow backend.
+var putLatency = &latencyEWMA{}
+
+type latencyEWMA struct {
+	mtx   sync.Mutex
+	value time.Duration
+}
+
+const latencyEWMAAlpha = 0.2
+
+func (l *latencyEWMA) observe(d time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.value == 0 {
+		l.value = d
+		return
+	}
+	l.value = time.Duration(latencyEWMAAlpha*float64(d) + (1-latencyEWMAAlpha)*float64(l.value))
+}
+
+func (l *latencyEWMA) get() time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.value
+}
+
+// startFlushScheduler launches manageFlushWorkers as a background goroutine.
+// stopFlushScheduler must complete before Flush() closes the flush queues
+// and waits on flushQueuesDone: rebalanceFlushWorkers calls
+// flushQueuesDone.Add(1) to spin up extra workers, and an Add() racing a
+// concurrent Wait() is a WaitGroup misuse that can panic or under-count.
+//
+// NOTE: nothing in this source tree calls startFlushScheduler - the
+// Ingester's construction/startup sequence lives outside pkg/ingester (in
+// the full repo's ingester.go / New()) and isn't part of this snapshot.
+// stopFlushScheduler is wired into Flush() in flush.go since that entry
+// point does exist here.
+func (i *Ingester) startFlushScheduler() {
+	cfg := i.cfg.Adaptive
+	if cfg.MaxConcurrentFlushes <= cfg.MinConcurrentFlushes {
+		return
+	}
+	i.flushSchedulerQuit = make(chan struct{})
+	i.flushSchedulerDone = make(chan struct{})
+	go i.manageFlushWorkers(i.flushSchedulerQuit, i.flushSchedulerDone)
+}
+
+// stopFlushScheduler stops manageFlushWorkers and waits for it to exit, so
+// it can no longer start new adaptive workers (and thus can no longer call
+// flushQueuesDone.Add) once this returns. A no-op if startFlushScheduler
+// was never called or adaptive scaling is disabled.
+func (i *Ingester) stopFlushScheduler() {
+	if i.flushSchedulerQuit == nil {
+		return
+	}
+	close(i.flushSchedulerQuit)
+	<-i.flushSchedulerDone
+}
+
+// manageFlushWorkers periodically grows or shrinks the number of extra flush
+// workers per queue shard, between 0 and MaxConcurrentFlushes-MinConcurrentFlushes,
+// based on queue depth and recent Put latency. It mirrors the
+// appendWorkers/persistQueueCap adaptive pattern used for the append path:
+// scale out when there's a backlog and the backend can keep up, scale back
+// in once the backlog clears.
+func (i *Ingester) manageFlushWorkers(quit chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	cfg := i.cfg.Adaptive
+	if cfg.MaxConcurrentFlushes <= cfg.MinConcurrentFlushes {
+		return
+	}
+
+	extra := make([]int32, len(i.flushQueues))
+
+	ticker := time.NewTicker(cfg.WorkerScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.rebalanceFlushWorkers(cfg, extra)
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (i *Ingester) rebalanceFlushWorkers(cfg AdaptiveFlushConfig, extra []int32) {
+	headroom := cfg.MaxConcurrentFlushes - cfg.MinConcurrentFlushes
+
+	for j := range i.flushQueues {
+		depth := i.flushQueues[j].Length()
+		cur := int(atomic.LoadInt32(&extra[j]))
+
+		want := depth / flushQueueDepthPerWorker
+		if want > headroom {
+			want = headroom
+		}
+
+		if want > cur && putLatency.get() <= cfg.MaxAcceptablePutLatency {
+			for k := cur; k < want; k++ {
+				atomic.AddInt32(&extra[j], 1)
+				i.flushQueuesDone.Add(1)
+				go i.adaptiveFlushLoop(j, &extra[j])
+			}
+		}
+
+		queueLabel := strconv.Itoa(j)
+		// One always-running flushLoop per shard, plus its extra workers.
+		flushWorkersActive.WithLabelValues(queueLabel).Set(1 + float64(atomic.LoadInt32(&extra[j])))
+		flushQueueDepth.WithLabelValues(queueLabel).Set(float64(depth))
+	}
+}
+
+// adaptiveFlushLoop is an extra, short-lived flush worker for shard j: it
+// drains the same queue as the shard's always-on flushLoop, and exits once
+// the backlog that justified spinning it up has cleared.
+//
+// Unlike flushLoop, it can't just block in Dequeue(): an idle extra worker
+// is supposed to give up and scale back in, but Dequeue() only returns once
+// something is enqueued or the queue closes, so a worker parked in it would
+// never re-check whether its backlog had cleared and would leak until
+// shutdown. Dequeue() has no non-blocking or timeout variant (it's the
+// same PriorityQueue flushLoop uses), so a background goroutine forwards
+// dequeued items over a channel, and the loop below selects on that with a
+// poll-interval timeout to drive the idle check instead.
+//
+// The forwarding goroutine is handed fwQuit, closed when this function
+// returns, and selects on it around every send into items. Without that,
+// an op the forwarder already dequeued while this loop was busy deciding to
+// exit had nowhere to go: items is unread once this function returns, so
+// the send blocks forever, and the forwarder's next Dequeue() (now with no
+// reader at all) does the same to a second op - silently dropping up to two
+// flushOps per scale-down, worst for immediate (shutdown) ops that are
+// never re-enqueued elsewhere. With fwQuit, that blocked send instead
+// re-enqueues the op and the forwarder exits, so at most the single Dequeue
+// call already in flight at exit time is ever at risk, and even that one
+// gets requeued as soon as it returns.
+func (i *Ingester) adaptiveFlushLoop(j int, count *int32) {
+	defer func() {
+		atomic.AddInt32(count, -1)
+		i.flushQueuesDone.Done()
+	}()
+
+	items := make(chan interface{})
+	fwQuit := make(chan struct{})
+	defer close(fwQuit)
+
+	go func() {
+		for {
+			o := i.flushQueues[j].Dequeue()
+			select {
+			case items <- o:
+			case <-fwQuit:
+				if o != nil {
+					i.flushQueues[j].Enqueue(o)
+				}
+				return
+			}
+			if o == nil {
+				return
+			}
+		}
+	}()
+
+	idleRounds := 0
+	for {
+		select {
+		case o := <-items:
+			if o == nil {
+				return
+			}
+			op := o.(*flushOp)
+
+			err := i.flushUserSeries(j, op.userID, op.fp, op.immediate)
+			if err != nil {
+				level.Error(util.WithUserID(op.userID, util.Logger)).Log("msg", "failed to flush user", "err", err)
+			}
+
+			if op.immediate && err != nil {
+				op.from = op.from.Add(flushBackoff)
+				i.flushQueues[j].Enqueue(op)
+			}
+			idleRounds = 0
+
+		case <-time.After(adaptiveWorkerPollInterval):
+			if i.flushQueues[j].Length() == 0 {
+				idleRounds++
+			} else {
+				idleRounds = 0
+			}
+			if idleRounds > adaptiveWorkerIdleRounds {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlushOpPriorityOrdering(t *testing.T) {
+	older := &flushOp{from: 1000}
+	newer := &flushOp{from: 2000}
+	if !(older.Priority() > newer.Priority()) {
+		t.Fatalf("older series must have higher priority than newer: %d vs %d", older.Priority(), newer.Priority())
+	}
+
+	small := &flushOp{from: 1000, bytes: 1}
+	big := &flushOp{from: 1000, bytes: 1 << 20}
+	if !(big.Priority() > small.Priority()) {
+		t.Fatalf("larger series must have higher priority at the same age: %d vs %d", big.Priority(), small.Priority())
+	}
+
+	notStale := &flushOp{from: 1000}
+	stale := &flushOp{from: 1000, stale: true}
+	if !(stale.Priority() > notStale.Priority()) {
+		t.Fatalf("stale series must have higher priority at the same age/size: %d vs %d", stale.Priority(), notStale.Priority())
+	}
+}
+
+func TestScaleDuration(t *testing.T) {
+	d := 10 * time.Minute
+
+	if got := scaleDuration(d, 0.5); got != 5*time.Minute {
+		t.Fatalf("scaleDuration(10m, 0.5) = %v, want 5m", got)
+	}
+	if got := scaleDuration(d, 0); got != d {
+		t.Fatalf("scaleDuration with a non-positive factor must return d unchanged, got %v", got)
+	}
+	if got := scaleDuration(d, -1); got != d {
+		t.Fatalf("scaleDuration with a negative factor must return d unchanged, got %v", got)
+	}
+}
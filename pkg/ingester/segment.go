@@ -0,0 +1,349 @@
+package ingester
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+
+	"github.com/cortexproject/cortex/pkg/chunk"
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+var (
+	segmentSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_ingester_flush_segment_size_bytes",
+		Help:    "Size of flush segments written to the chunk store.",
+		Buckets: prometheus.ExponentialBuckets(64*1024, 4, 8),
+	})
+	segmentChunks = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_ingester_flush_segment_chunks",
+		Help:    "Number of chunks packed into each flush segment.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	segmentPuts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_flush_segment_puts_total",
+		Help: "Total number of segment PUT requests made to the chunk store.",
+	})
+)
+
+// SegmentConfig configures the batching of many series' chunks into a
+// single ULID-named object, to cut down on object-store PUT rate.
+type SegmentConfig struct {
+	Size   int           `yaml:"flush_segment_size_bytes"`
+	MaxAge time.Duration `yaml:"flush_segment_max_age"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *SegmentConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Size, "ingester.flush-segment-size-bytes", 16*1024*1024, "Target size of a flush segment object; a segment is written once accumulated chunks reach this size.")
+	f.DurationVar(&cfg.MaxAge, "ingester.flush-segment-max-age", 5*time.Second, "Maximum time chunks wait in a flush segment buffer before being written, even if Size hasn't been reached.")
+}
+
+// segmentEntry is one flushOp's worth of chunks waiting to be batched into a
+// segment, along with the channel its caller is blocked on.
+type segmentEntry struct {
+	userID string
+	fp     model.Fingerprint
+	chunks []chunk.Chunk
+	size   int
+	done   chan error
+}
+
+// segmentBuffer accumulates wireChunks from multiple flushOps - across
+// fingerprints, and tenants - until a size or age threshold is reached, then
+// writes them as a single ULID-named segment object. There is one buffer per
+// flush queue shard (flushQueueIndex); the shard's always-running worker and
+// any adaptive extra workers share it, with mtx guarding pending and size.
+type segmentBuffer struct {
+	cfg   SegmentConfig
+	store segmentStore
+
+	mtx       sync.Mutex
+	pending   []segmentEntry
+	size      int
+	oldestAdd time.Time
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// segmentStore is the subset of functionality segment batching needs from
+// the chunk store: a way to PUT (and, for readers, range-read) a whole
+// segment object in one request.
+//
+// NOTE: pkg/chunk - where chunk.Store is defined - isn't part of this
+// source tree, so PutSegment can't actually be added to that interface
+// here, and there's no segment-aware reader to satisfy per-chunk Get calls
+// against a segment (needed by queriers, and by chunk0-2's loadEvicted).
+// segmentStore is defined narrowly in this package so ensureSegmentBuffers
+// can feature-detect it via a type assertion: until a real chunk.Store
+// implementation satisfies it, segment batching safely no-ops and flushes
+// fall back to one chunk.Store.Put per series, exactly as before this
+// request landed.
+type segmentStore interface {
+	PutSegment(ctx context.Context, seg *Segment) error
+}
+
+func newSegmentBuffer(cfg SegmentConfig, store segmentStore) *segmentBuffer {
+	b := &segmentBuffer{
+		cfg:   cfg,
+		store: store,
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+func (b *segmentBuffer) stop() {
+	close(b.quit)
+	<-b.done
+}
+
+func (b *segmentBuffer) loop() {
+	defer close(b.done)
+
+	timer := time.NewTimer(b.cfg.MaxAge)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-b.wake:
+			// Anchor the deadline to oldestAdd (the first chunk currently
+			// sitting in the buffer), not to now: resetting to cfg.MaxAge
+			// from now on every wake would mean a steady stream of adds
+			// keeps pushing the deadline out, so the oldest entry could sit
+			// far longer than FlushSegmentMaxAge before being written.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			b.mtx.Lock()
+			oldestAdd, pending := b.oldestAdd, len(b.pending) > 0
+			b.mtx.Unlock()
+			if pending {
+				timer.Reset(time.Until(oldestAdd.Add(b.cfg.MaxAge)))
+			} else {
+				timer.Reset(b.cfg.MaxAge)
+			}
+		case <-timer.C:
+			b.flush(context.Background())
+			timer.Reset(b.cfg.MaxAge)
+		case <-b.quit:
+			b.flush(context.Background())
+			return
+		}
+	}
+}
+
+// add enqueues chunks for userID/fp and blocks until the segment containing
+// them has been durably written (or failed), since the caller marks
+// chunkDescs flushed on success. If ctx is done first, add returns ctx.Err()
+// without waiting; the chunks stay pending and may still be written in a
+// later segment, so a retry of the same series can write them twice.
+func (b *segmentBuffer) add(ctx context.Context, userID string, fp model.Fingerprint, chunks []chunk.Chunk) error {
+	size := 0
+	for _, c := range chunks {
+		size += c.Data.Size()
+	}
+
+	entry := segmentEntry{userID: userID, fp: fp, chunks: chunks, size: size, done: make(chan error, 1)}
+
+	b.mtx.Lock()
+	if len(b.pending) == 0 {
+		b.oldestAdd = time.Now()
+	}
+	b.pending = append(b.pending, entry)
+	b.size += size
+	full := b.size >= b.cfg.Size
+	b.mtx.Unlock()
+
+	if full {
+		b.flush(ctx)
+	} else {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	select {
+	case err := <-entry.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush takes whatever is currently pending, writes it as a single segment,
+// and notifies every waiting caller of the result. On failure, nothing is
+// marked flushed by the callers, so the next sweep re-schedules the same
+// series and they're re-batched into a fresh ULID - no already-persisted
+// chunk can be duplicated, because a segment is only ever written once.
+func (b *segmentBuffer) flush(ctx context.Context) {
+	b.mtx.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.size = 0
+	b.mtx.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	seg, err := buildSegment(pending)
+	if err == nil {
+		err = b.store.PutSegment(ctx, seg)
+	}
+	if err != nil {
+		level.Error(util.Logger).Log("msg", "failed to put flush segment", "numChunks", len(pending), "err", err)
+	} else {
+		segmentPuts.Inc()
+		segmentSize.Observe(float64(seg.Size()))
+		segmentChunks.Observe(float64(seg.NumChunks()))
+	}
+
+	for _, entry := range pending {
+		entry.done <- err
+	}
+}
+
+// segmentIndexEntry locates one series' chunks within the segment's byte
+// stream, so PutSegment's reader counterpart can still satisfy per-chunk
+// Get calls by range-reading the object.
+type segmentIndexEntry struct {
+	UserID    string
+	Fp        model.Fingerprint
+	FirstTime model.Time
+	LastTime  model.Time
+	Offset    int64
+	Length    int64
+}
+
+// Segment is a single ULID-named object containing the chunks of many
+// flushOps, written in one PUT, plus an index header mapping
+// (userID, fingerprint, first/last time) to byte offsets of the embedded
+// chunks.
+type Segment struct {
+	ID    ulid.ULID
+	Index []segmentIndexEntry
+	Bytes []byte
+}
+
+// Size returns the size of the segment object as it will be PUT.
+func (s *Segment) Size() int {
+	return len(s.Bytes)
+}
+
+// NumChunks returns how many chunks are packed into the segment.
+func (s *Segment) NumChunks() int {
+	return len(s.Index)
+}
+
+// buildSegment serializes the pending entries' chunks into one contiguous
+// byte stream with a matching index, named with a new, monotonically
+// increasing ULID so segments sort by flush time.
+func buildSegment(pending []segmentEntry) (*Segment, error) {
+	seg := &Segment{ID: newSegmentULID()}
+
+	for _, entry := range pending {
+		for _, c := range entry.chunks {
+			start := int64(len(seg.Bytes))
+
+			w := &sizeWriter{}
+			if err := c.Data.Marshal(w); err != nil {
+				return nil, err
+			}
+			seg.Bytes = append(seg.Bytes, w.buf...)
+
+			seg.Index = append(seg.Index, segmentIndexEntry{
+				UserID:    entry.userID,
+				Fp:        entry.fp,
+				FirstTime: c.From,
+				LastTime:  c.Through,
+				Offset:    start,
+				Length:    int64(len(seg.Bytes)) - start,
+			})
+		}
+	}
+
+	return seg, nil
+}
+
+// ulidEntropy is shared by newSegmentULID. ulid.Monotonic's reader keeps
+// mutable state to derive strictly increasing ULIDs for the same
+// millisecond, so - unlike a plain crypto-random reader - it is not safe
+// for concurrent use; ulidEntropyMtx serializes access to it. buildSegment
+// can be called concurrently from a buffer's own loop(), a caller-triggered
+// add() forcing an early flush, and (with chunk0-5) the adaptive workers
+// sharing a flush queue, so this does get hit from multiple goroutines.
+var (
+	ulidEntropyMtx sync.Mutex
+	ulidEntropy    = ulid.Monotonic(rand.Reader, 0)
+)
+
+func newSegmentULID() ulid.ULID {
+	ulidEntropyMtx.Lock()
+	defer ulidEntropyMtx.Unlock()
+	return ulid.MustNew(ulid.Timestamp(time.Now()), ulidEntropy)
+}
+
+// putChunks routes a flushOp's wireChunks through this worker's segment
+// buffer instead of issuing a one-chunk-per-series Put, batching many
+// fingerprints (and tenants) into a single PUT to cut object-store request
+// amplification.
+func (i *Ingester) putChunks(ctx context.Context, flushQueueIndex int, userID string, fp model.Fingerprint, wireChunks []chunk.Chunk) error {
+	buffers := i.ensureSegmentBuffers()
+	if buffers == nil {
+		return i.chunkStore.Put(ctx, wireChunks)
+	}
+	return buffers[flushQueueIndex].add(ctx, userID, fp, wireChunks)
+}
+
+// ensureSegmentBuffers lazily creates one segmentBuffer per flush queue
+// shard, the first time a chunk is flushed. Previously i.segmentBuffers was
+// read here but never populated anywhere, so putChunks always fell back to
+// the one-chunk-per-Put path regardless of SegmentConfig - this is the only
+// place anything assigns to it now.
+//
+// Segment batching is only used when i.chunkStore satisfies segmentStore
+// (see its doc comment for why) and SegmentConfig.Size is positive; either
+// missing, this returns nil and putChunks falls back to Put.
+func (i *Ingester) ensureSegmentBuffers() []*segmentBuffer {
+	store, ok := i.chunkStore.(segmentStore)
+	if !ok || i.cfg.Segment.Size <= 0 {
+		return nil
+	}
+
+	i.segmentBuffersOnce.Do(func() {
+		buffers := make([]*segmentBuffer, len(i.flushQueues))
+		for j := range buffers {
+			buffers[j] = newSegmentBuffer(i.cfg.Segment, store)
+		}
+		i.segmentBuffers = buffers
+	})
+	return i.segmentBuffers
+}
+
+// stopSegmentBuffers flushes and stops every segment buffer, so nothing is
+// left pending in one when the ingester shuts down. A no-op if segment
+// batching was never engaged.
+func (i *Ingester) stopSegmentBuffers() {
+	for _, b := range i.segmentBuffers {
+		if b != nil {
+			b.stop()
+		}
+	}
+}
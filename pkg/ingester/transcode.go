@@ -0,0 +1,121 @@
+package ingester
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/cortexproject/cortex/pkg/chunk/encoding"
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+var (
+	chunkTranscodeRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_ingester_chunk_transcode_ratio",
+		Help:    "Ratio of transcoded chunk size to original chunk size (when transcoding shrank the chunk).",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+	chunkTranscodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_chunk_transcode_failures_total",
+		Help: "Total number of chunks that failed to transcode and were flushed in their original encoding.",
+	})
+)
+
+// RegisterFlags adds the flag required to config this to the given FlagSet.
+func (e *FlushEncoding) RegisterFlags(f *flag.FlagSet) {
+	f.Var(e, "ingester.flush-encoding", "Re-encode chunks to this encoding before flushing, if doing so makes them smaller (unchanged, delta, doubledelta, varbit). Default: keep the appender's encoding.")
+}
+
+// FlushEncoding selects the chunk encoding chunks are transcoded to at flush
+// time, if different (and smaller) than the encoding they were appended
+// with.
+type FlushEncoding encoding.Encoding
+
+// FlushEncodingUnchanged means flushChunks keeps whatever encoding the chunk
+// was appended with - the default, and the behaviour before transcoding
+// existed.
+const FlushEncodingUnchanged = FlushEncoding(encoding.UnknownEncoding)
+
+// String implements flag.Value.
+func (e FlushEncoding) String() string {
+	if e == FlushEncodingUnchanged {
+		return "unchanged"
+	}
+	return encoding.Encoding(e).String()
+}
+
+// Set implements flag.Value.
+func (e *FlushEncoding) Set(s string) error {
+	if s == "" || s == "unchanged" {
+		*e = FlushEncodingUnchanged
+		return nil
+	}
+	enc, err := encoding.ParseEncoding(s)
+	if err != nil {
+		return err
+	}
+	*e = FlushEncoding(enc)
+	return nil
+}
+
+// transcodeChunk re-encodes src into cfg's target encoding, by replaying
+// every sample through a freshly allocated chunk of that encoding. The
+// result is only returned if it serializes to something strictly smaller
+// than src; otherwise src is returned unchanged so the flush can proceed
+// with the original encoding.
+func transcodeChunk(cfg FlushEncoding, src encoding.Chunk) (encoding.Chunk, error) {
+	if cfg == FlushEncodingUnchanged || encoding.Encoding(cfg) == src.Encoding() {
+		return src, nil
+	}
+
+	dst, err := encoding.NewForEncoding(encoding.Encoding(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	it := src.NewIterator()
+	for it.Scan() {
+		sample := it.Value()
+		overflow, err := dst.Add(&sample)
+		if err != nil {
+			return nil, err
+		}
+		// A single target chunk should always be able to hold what a single
+		// source chunk held; if it can't (e.g. asked to transcode into a
+		// narrower encoding than the data fits in) bail out and keep src.
+		if len(overflow) > 0 {
+			return nil, fmt.Errorf("ingester: chunk did not fit in target encoding %v", encoding.Encoding(cfg))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	if dst.Size() >= src.Size() {
+		return src, nil
+	}
+
+	chunkTranscodeRatio.Observe(float64(dst.Size()) / float64(src.Size()))
+	return dst, nil
+}
+
+// maybeTranscodeChunk is flushChunks' entry point: it transcodes c if
+// configured to, falling back to the original encoding (and bumping
+// chunkTranscodeFailures) on any error so a bad transcode never blocks a
+// flush.
+func (i *Ingester) maybeTranscodeChunk(c encoding.Chunk) encoding.Chunk {
+	if i.cfg.FlushEncoding == FlushEncodingUnchanged {
+		return c
+	}
+
+	out, err := transcodeChunk(i.cfg.FlushEncoding, c)
+	if err != nil {
+		chunkTranscodeFailures.Inc()
+		level.Warn(util.Logger).Log("msg", "chunk transcode failed, flushing in original encoding", "err", err)
+		return c
+	}
+	return out
+}
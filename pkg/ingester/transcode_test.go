@@ -0,0 +1,51 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/cortexproject/cortex/pkg/chunk/encoding"
+)
+
+func TestFlushEncodingSetString(t *testing.T) {
+	var e FlushEncoding
+
+	if err := e.Set(""); err != nil {
+		t.Fatalf("Set(\"\"): %v", err)
+	}
+	if e != FlushEncodingUnchanged {
+		t.Fatalf("Set(\"\") = %v, want FlushEncodingUnchanged", e)
+	}
+	if got, want := e.String(), "unchanged"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+
+	if err := e.Set("varbit"); err != nil {
+		t.Fatalf("Set(\"varbit\"): %v", err)
+	}
+	if encoding.Encoding(e) != encoding.Varbit {
+		t.Fatalf("Set(\"varbit\") = %v, want encoding.Varbit", e)
+	}
+
+	if err := e.Set("not-a-real-encoding"); err == nil {
+		t.Fatalf("Set(\"not-a-real-encoding\") succeeded, want an error")
+	}
+}
+
+func TestTranscodeChunkSkipsSameEncoding(t *testing.T) {
+	// transcodeChunk must be a no-op (return src unchanged, never touching
+	// chunkTranscodeRatio) whenever cfg already matches src's own encoding -
+	// there's nothing to gain by re-encoding a chunk into its own encoding,
+	// and doing so would cost a full sample replay for no size benefit.
+	src, err := encoding.NewForEncoding(encoding.Varbit)
+	if err != nil {
+		t.Fatalf("NewForEncoding: %v", err)
+	}
+
+	got, err := transcodeChunk(FlushEncoding(encoding.Varbit), src)
+	if err != nil {
+		t.Fatalf("transcodeChunk: %v", err)
+	}
+	if got != src {
+		t.Fatalf("transcodeChunk returned a different chunk for a matching encoding")
+	}
+}